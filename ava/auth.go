@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookieName = "session"
+const sessionDuration = 30 * 24 * time.Hour
+
+// bcryptCost is the bcrypt work factor used for every password hashed by
+// registerUser.
+const bcryptCost = 12
+
+var ErrInvalidCredentials = errors.New("invalid email or password")
+var ErrUnauthorized = errors.New("unauthorized")
+
+// registerUser hashes password with bcrypt (cost bcryptCost) and inserts
+// a new row into users. It's the only path that can populate
+// users.password_hash, invoked via `ava --create-user email:password`.
+func registerUser(email, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO users (email, password_hash) VALUES ($1, $2)`,
+		strings.ToLower(email), hash)
+	return err
+}
+
+// handlerLogin serves the login form.
+func handlerLogin(c *echo.Context) error {
+	tmpl, err := template.ParseFiles("assets/html/login.html")
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(c.Response().Writer(), struct{}{})
+}
+
+// handlerLoginSubmit verifies the submitted credentials against the users
+// table, and on success issues a new session token, storing it (hashed)
+// in the sessions table and setting it as an httpOnly, Secure cookie.
+func handlerLoginSubmit(c *echo.Context) error {
+	email := strings.ToLower(c.Form("email"))
+	password := c.Form("password")
+	if len(email) == 0 || len(password) == 0 {
+		return ErrInvalidCredentials
+	}
+	var uid int
+	var hash string
+	row := db.QueryRow(
+		`SELECT id, password_hash FROM users WHERE email=$1`, email)
+	if err := row.Scan(&uid, &hash); err != nil {
+		return ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash),
+		[]byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	// Rotate: a successful login invalidates every session already
+	// issued for this user before minting the new one.
+	if err := revokeSessions(uid); err != nil {
+		return err
+	}
+	token, err := newSession(uid, c.Request().UserAgent(),
+		c.Request().RemoteAddr)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(c, token)
+	return c.HTML(http.StatusOK, "logged in")
+}
+
+// handlerLogout revokes the current session and clears its cookie.
+func handlerLogout(c *echo.Context) error {
+	if cookie, err := c.Request().Cookie(sessionCookieName); err == nil {
+		db.Exec(`DELETE FROM sessions WHERE token_hash=$1`,
+			hashToken(cookie.Value))
+	}
+	http.SetCookie(c.Response().Writer(), &http.Cookie{
+		Name:    sessionCookieName,
+		Value:   "",
+		Path:    "/",
+		Expires: time.Unix(0, 0),
+	})
+	return c.HTML(http.StatusOK, "logged out")
+}
+
+// newSession creates a random 32-byte session token, persists its hash,
+// and returns the raw token to be set as a cookie.
+func newSession(uid int, userAgent, ip string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.URLEncoding.EncodeToString(b)
+	_, err := db.Exec(
+		`INSERT INTO sessions (token_hash, uid, expires_at, user_agent, ip)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		hashToken(token), uid, time.Now().Add(sessionDuration), userAgent, ip)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokeSessions deletes every session issued for uid, so a fresh login
+// rotates out any tokens issued before it.
+func revokeSessions(uid int) error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE uid=$1`, uid)
+	return err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func setSessionCookie(c *echo.Context, token string) {
+	http.SetCookie(c.Response().Writer(), &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionDuration),
+		HttpOnly: true,
+		Secure:   true,
+	})
+}
+
+// sessionFromRequest looks up the uid for a session cookie, verifying it
+// hasn't expired. Token comparison happens via the sha256 hash stored in
+// the sessions table, so the raw token never touches a query.
+func sessionFromRequest(r *http.Request) (int, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || len(cookie.Value) == 0 {
+		return 0, ErrUnauthorized
+	}
+	var uid int
+	var expiresAt time.Time
+	row := db.QueryRow(
+		`SELECT uid, expires_at FROM sessions WHERE token_hash=$1`,
+		hashToken(cookie.Value))
+	if err := row.Scan(&uid, &expiresAt); err != nil {
+		return 0, ErrUnauthorized
+	}
+	if time.Now().After(expiresAt) {
+		return 0, ErrUnauthorized
+	}
+	return uid, nil
+}
+
+// cmdRequiresAuth reports whether cmd needs a logged-in user. It mirrors
+// the bypass in handlerMain, where "train ..." is handled before any user
+// lookup happens.
+func cmdRequiresAuth(cmd string) bool {
+	if len(cmd) == 0 {
+		return false
+	}
+	return len(cmd) < 5 || strings.ToLower(cmd)[0:5] != "train"
+}
+
+// sessionMiddleware resolves the session cookie on every request and
+// stores the uid on the echo.Context, so handlerMain and validateParams
+// can derive the user's identity from the session instead of trusting
+// form input. Requests whose cmd implies a user-scoped action are
+// rejected with 401 when no valid session is present.
+func sessionMiddleware() echo.MiddlewareFunc {
+	return func(h echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			uid, err := sessionFromRequest(c.Request())
+			if err == nil {
+				c.Set("uid", uid)
+			} else if cmdRequiresAuth(c.Form("cmd")) {
+				return c.HTML(http.StatusUnauthorized,
+					"not logged in")
+			}
+			return h(c)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"log"
 	"math/rand"
@@ -9,8 +10,10 @@ import (
 	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
 
@@ -28,9 +31,18 @@ import (
 
 var db *sqlx.DB
 var bayes *bayesian.Classifier
+var loader *pkg.Loader
 var ErrInvalidCommand = errors.New("invalid command")
 var ErrMissingPackage = errors.New("missing package")
 
+// packagesDir holds compiled package plugins (built by `ava --install`)
+// that bootPackages loads at startup.
+const packagesDir = "packages"
+
+// defaultShutdownTimeout bounds how long startServer waits for in-flight
+// requests to drain once a shutdown signal arrives.
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
 	app := cli.NewApp()
@@ -51,16 +63,54 @@ func main() {
 			Name:  "install, i",
 			Usage: "install packages in package.json",
 		},
+		cli.StringFlag{
+			Name:  "shutdown-timeout",
+			Value: defaultShutdownTimeout.String(),
+			Usage: "how long to wait for in-flight requests to drain on shutdown",
+		},
+		cli.StringFlag{
+			Name:  "create-user",
+			Usage: "create a login user, as email:password",
+		},
 	}
 	app.Action = func(c *cli.Context) {
 		showHelp := true
 		if c.Bool("install") {
-			log.Println("TODO: install packages")
+			if err := pkg.Install("package.json", packagesDir); err != nil {
+				log.Println("err: install packages:", err)
+			}
+			showHelp = false
+		}
+		if raw := c.String("create-user"); len(raw) > 0 {
+			parts := strings.SplitN(raw, ":", 2)
+			if len(parts) != 2 {
+				log.Println("err: create-user expects email:password")
+			} else {
+				db = connectDB()
+				if err := registerUser(parts[0], parts[1]); err != nil {
+					log.Println("err: create user:", err)
+				} else {
+					log.Println("created user", parts[0])
+				}
+			}
 			showHelp = false
 		}
 		if c.Bool("server") {
+			shutdownTimeout, err := time.ParseDuration(c.String("shutdown-timeout"))
+			if err != nil {
+				log.Println("err: parsing shutdown-timeout:", err)
+				shutdownTimeout = defaultShutdownTimeout
+			}
 			db = connectDB()
-			startServer(c.String("port"))
+			ctx, cancel := context.WithCancel(context.Background())
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-sig
+				log.Println("shutting down")
+				cancel()
+			}()
+			startServer(ctx, c.String("port"), shutdownTimeout)
 			showHelp = false
 		}
 		if showHelp {
@@ -70,7 +120,7 @@ func main() {
 	app.Run(os.Args)
 }
 
-func startServer(port string) {
+func startServer(ctx context.Context, port string, shutdownTimeout time.Duration) {
 	var err error
 	if err = godotenv.Load(); err != nil {
 		log.Println("err: loading environment:", err)
@@ -82,17 +132,94 @@ func startServer(port string) {
 	if err != nil {
 		log.Println("err: loading classifier:", err)
 	}
+	if err := replayTrainingPairs(bayes); err != nil {
+		log.Println("err: replaying training pairs:", err)
+	}
+	loadConfidenceThreshold()
 	log.Println("booting local server")
-	bootRPCServer(port)
+	bootPackages()
+	rpcListener := bootRPCServer(ctx, port)
 	bootTwilio()
 	bootDependencies()
 	e := echo.New()
 	initRoutes(e)
+	srv := &http.Server{
+		Addr:         ":" + port,
+		Handler:      e,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Println("err: listen and serve:", err)
+		}
+	}()
 	log.Println("booted ava")
-	e.Run(":" + port)
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("err: http shutdown:", err)
+	}
+	if rpcListener != nil {
+		if err := rpcListener.Close(); err != nil {
+			log.Println("err: closing rpc listener:", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		log.Println("err: closing db:", err)
+	}
+	log.Println("shutdown complete")
+}
+
+// bootPackages loads compiled package plugins from packagesDir and trains
+// bayes on each one's trigger phrases. This is the default transport for
+// dispatching to packages; bootRPCServer stays up alongside it only as a
+// fallback for packages that run out-of-process.
+func bootPackages() {
+	loader = pkg.NewLoader(packagesDir)
+	if err := loader.Load(); err != nil {
+		log.Println("err: loading packages:", err)
+	}
+	for _, p := range loader.Packages {
+		for _, trigger := range p.Config.Triggers {
+			if err := trainClass(bayes, p.Config.Name, trigger); err != nil {
+				log.Println("err: training on package trigger:", err)
+			}
+		}
+	}
+}
+
+// dispatchPkg routes m to the package named by its classified command.
+// In-process plugins loaded by bootPackages are tried first; if none is
+// loaded under that name, it falls back to the RPC transport via
+// callPkg. The returned PkgWrapper's Route is "plugin" when an
+// in-process plugin served the request and, on the RPC fallback, the
+// route returned by callPkg, so callers can record it alongside the
+// reply.
+func dispatchPkg(m *datatypes.Message, ctxAdded bool) (string, *pkg.PkgWrapper, error) {
+	var name string
+	if m.Input != nil && m.Input.StructuredInput != nil {
+		name = m.Input.StructuredInput.Command
+	}
+	if loader != nil {
+		if p, err := loader.Get(name); err == nil {
+			ret, err := p.P.Run(m)
+			return ret, &pkg.PkgWrapper{P: p, Name: p.Config.Name, Route: "plugin"}, err
+		}
+	}
+	ret, route, err := callPkg(m, ctxAdded)
+	return ret, &pkg.PkgWrapper{Name: name, Route: route}, err
 }
 
-func bootRPCServer(port string) {
+// bootRPCServer listens for out-of-process packages that can't be loaded
+// as in-process plugins by bootPackages. In-process plugins are preferred
+// since they avoid this port allocation and the RPC round trip per turn.
+// The returned listener is closed by startServer on shutdown; each
+// accepted connection is torn down as soon as ctx is done rather than
+// blocking forever on a stuck package.
+func bootRPCServer(ctx context.Context, port string) net.Listener {
 	ava := new(Ava)
 	if err := rpc.Register(ava); err != nil {
 		log.Println("register ava in rpc", err)
@@ -106,16 +233,67 @@ func bootRPCServer(port string) {
 	log.Println("booting rpc server", pt)
 	if err != nil {
 		log.Println("err: rpc listen: ", err)
+		return nil
 	}
 	go func() {
 		for {
 			conn, err := l.Accept()
 			if err != nil {
-				log.Println("err: rpc accept: ", err)
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					log.Println("err: rpc accept: ", err)
+					continue
+				}
 			}
-			go rpc.ServeConn(conn)
+			go serveRPCConn(ctx, conn)
+		}
+	}()
+	return l
+}
+
+// rpcIdleTimeout bounds how long an RPC connection may go without a
+// successful read or write before it's torn down, so a slow client or a
+// stuck package call can't pin its goroutine forever during normal
+// operation.
+const rpcIdleTimeout = 60 * time.Second
+
+// deadlineConn wraps a net.Conn so every Read/Write refreshes its
+// deadline, turning rpcIdleTimeout into a rolling idle timeout rather
+// than a one-shot deadline set at accept time.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// serveRPCConn serves a single RPC connection under a rolling idle
+// timeout, and also closes it as soon as ctx is cancelled. A watcher
+// goroutine forces the conn's deadline when ctx finishes, so the blocked
+// rpc.ServeConn read returns; cancelCh is closed once rpc.ServeConn
+// returns, which releases the watcher if ctx never finished.
+func serveRPCConn(ctx context.Context, conn net.Conn) {
+	cancelCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-cancelCh:
 		}
 	}()
+	dc := &deadlineConn{Conn: conn, timeout: rpcIdleTimeout}
+	rpc.ServeConn(dc)
+	close(cancelCh)
 }
 
 func connectDB() *sqlx.DB {
@@ -136,10 +314,12 @@ func initRoutes(e *echo.Echo) {
 	e.Static("/public/css", "assets/css")
 	e.Static("/public/images", "assets/images")
 	e.Get("/", handlerIndex)
-	e.Post("/", handlerMain)
+	e.Post("/", handlerMain, sessionMiddleware())
 	e.Post("/twilio", handlerTwilio)
 	e.Get("/login", handlerLogin)
 	e.Post("/login", handlerLoginSubmit)
+	e.Post("/logout", handlerLogout)
+	e.Post("/feedback", handlerFeedback)
 }
 
 func handlerIndex(c *echo.Context) error {
@@ -159,12 +339,6 @@ func handlerIndex(c *echo.Context) error {
 	return nil
 }
 
-// TODO
-func handlerTwilio(c *echo.Context) error {
-	log.Println("twilio endpoint not implemented")
-	return errors.New("not implemented")
-}
-
 func handlerMain(c *echo.Context) error {
 	cmd := c.Form("cmd")
 	if len(cmd) == 0 {
@@ -174,6 +348,9 @@ func handlerMain(c *echo.Context) error {
 	var err error
 	var uid, fidT int
 	var ctxAdded bool
+	var confidence float64
+	var candidates []string
+	var pending *pendingDisambiguation
 	var pw *pkg.PkgWrapper
 	var m *datatypes.Message
 	var u *datatypes.User
@@ -185,14 +362,37 @@ func handlerMain(c *echo.Context) error {
 		}
 		goto Response
 	}
-	si, err = classify(bayes, cmd)
-	if err != nil {
-		log.Println("classifying sentence ", err)
-	}
 	uid, fid, fidT, err = validateParams(c)
 	if err != nil {
 		return err
 	}
+	pending, err = getPendingDisambiguation(uid)
+	if err != nil && err != ErrNoPendingDisambiguation {
+		log.Println("getPendingDisambiguation: ", err)
+	}
+	if pending != nil {
+		if err := clearPendingDisambiguation(uid); err != nil {
+			log.Println("clearPendingDisambiguation: ", err)
+		}
+		if class, ok := pending.match(cmd); ok {
+			if err := trainClass(bayes, class, pending.Cmd); err != nil {
+				log.Println("trainClass: ", err)
+			}
+			ret = "Got it, thanks!"
+			goto Response
+		}
+	}
+	si, confidence, candidates, err = classify(bayes, cmd)
+	if err != nil {
+		log.Println("classifying sentence ", err)
+	}
+	if confidence < confidenceThreshold && len(candidates) == 2 {
+		if err := savePendingDisambiguation(uid, cmd, candidates); err != nil {
+			log.Println("savePendingDisambiguation: ", err)
+		}
+		ret = disambiguationQuestion(candidates)
+		goto Response
+	}
 	in = &datatypes.Input{
 		StructuredInput: si,
 		UserId:          uid,
@@ -208,7 +408,7 @@ func handlerMain(c *echo.Context) error {
 	if err != nil {
 		log.Println("addContext: ", err)
 	}
-	ret, route, err = callPkg(m, ctxAdded)
+	ret, pw, err = dispatchPkg(m, ctxAdded)
 	if err != nil && err != ErrMissingPackage {
 		return err
 	}
@@ -216,7 +416,8 @@ func handlerMain(c *echo.Context) error {
 		ret = language.Confused()
 	}
 	if pw != nil {
-		pname = pw.P.Config.Name
+		pname = pw.Name
+		route = pw.Route
 	}
 	in.StructuredInput = si
 	if err := saveStructuredInput(in, ret, pname, route); err != nil {
@@ -230,25 +431,12 @@ Response:
 	return nil
 }
 
-// TODO
-func handlerLogin(c *echo.Context) error {
-	return errors.New("not implemented")
-}
-
-// TODO
-func handlerLoginSubmit(c *echo.Context) error {
-	return errors.New("not implemented")
-}
-
 func validateParams(c *echo.Context) (int, string, int, error) {
 	var uid, fidT int
 	var fid string
 	var err error
-	uid, err = strconv.Atoi(c.Form("uid"))
-	if err.Error() == `strconv.ParseInt: parsing "": invalid syntax` {
-		uid = 0
-	} else if err != nil {
-		return uid, fid, fidT, err
+	if sessionUid, ok := c.Get("uid").(int); ok {
+		uid = sessionUid
 	}
 	fidT, err = strconv.Atoi(c.Form("flexidtype"))
 	if err != nil && err.Error() == `strconv.ParseInt: parsing "": invalid syntax` {
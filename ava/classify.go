@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/avabot/ava/shared/datatypes"
+	"github.com/jbrukh/bayesian"
+)
+
+// defaultConfidenceThreshold is the minimum log-likelihood gap between
+// the top two candidate classes before handlerMain trusts classify's
+// pick, used unless CLASSIFIER_CONFIDENCE_THRESHOLD overrides it. Below
+// the threshold, handlerMain asks the user to disambiguate rather than
+// guess.
+const defaultConfidenceThreshold = 2.0
+
+// confidenceThreshold holds the effective threshold, set once by
+// loadConfidenceThreshold at boot.
+var confidenceThreshold = defaultConfidenceThreshold
+
+// loadConfidenceThreshold reads CLASSIFIER_CONFIDENCE_THRESHOLD from the
+// environment, falling back to defaultConfidenceThreshold when it's
+// unset or invalid.
+func loadConfidenceThreshold() {
+	raw := os.Getenv("CLASSIFIER_CONFIDENCE_THRESHOLD")
+	if len(raw) == 0 {
+		return
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Println("err: parsing CLASSIFIER_CONFIDENCE_THRESHOLD:", err)
+		return
+	}
+	confidenceThreshold = v
+}
+
+// classify runs cmd through the bayesian classifier, returning the
+// resulting StructuredInput, a confidence score (the log-likelihood gap
+// between the top two classes), and those top two classes so the caller
+// can offer them as a disambiguation question when confidence is low.
+func classify(bayes *bayesian.Classifier, cmd string) (*datatypes.StructuredInput, float64, []string, error) {
+	if bayes == nil {
+		return nil, 0, nil, errors.New("classifier not loaded")
+	}
+	words := strings.Fields(strings.ToLower(cmd))
+	scores, likely, _ := bayes.LogScores(words)
+	si := &datatypes.StructuredInput{
+		Command: string(bayes.Classes[likely]),
+	}
+	confidence, candidates := topTwo(bayes.Classes, scores)
+	return si, confidence, candidates, nil
+}
+
+// topTwo returns the log-likelihood gap between the best and second-best
+// scoring classes, along with their names in descending order.
+func topTwo(classes []bayesian.Class, scores []float64) (float64, []string) {
+	if len(scores) < 2 {
+		return 0, nil
+	}
+	type scored struct {
+		class string
+		score float64
+	}
+	ranked := make([]scored, len(scores))
+	for i, s := range scores {
+		ranked[i] = scored{class: string(classes[i]), score: s}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		return ranked[i].score > ranked[j].score
+	})
+	return ranked[0].score - ranked[1].score, []string{ranked[0].class, ranked[1].class}
+}
+
+// train teaches the classifier that the sentence in raw (formatted as
+// "<class> <sentence>") belongs to the given class, persisting the pair
+// so the corpus survives restarts.
+func train(bayes *bayesian.Classifier, raw string) error {
+	class, sentence, err := splitTrainingPair(raw)
+	if err != nil {
+		return err
+	}
+	return trainClass(bayes, class, sentence)
+}
+
+// trainClass teaches the classifier that sentence belongs to class and
+// persists the pair, independent of the "train <class> <sentence>" input
+// format so the online-learning feedback loop can call it directly.
+func trainClass(bayes *bayesian.Classifier, class, sentence string) error {
+	bayes.Learn(strings.Fields(strings.ToLower(sentence)), bayesian.Class(class))
+	return saveTrainingPair(class, sentence)
+}
+
+func splitTrainingPair(raw string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(raw), " ", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return "", "", errors.New("train: expected '<class> <sentence>'")
+	}
+	return parts[0], parts[1], nil
+}
+
+// saveTrainingPair persists a (class, sentence) pair to the training_pairs
+// table. startServer replays these via replayTrainingPairs after seeding
+// the classifier from its static corpus.
+func saveTrainingPair(class, sentence string) error {
+	_, err := db.Exec(
+		`INSERT INTO training_pairs (class, sentence) VALUES ($1, $2)`,
+		class, sentence)
+	return err
+}
+
+// replayTrainingPairs re-trains bayes with every persisted training pair,
+// so manual corrections and disambiguation answers survive a restart.
+func replayTrainingPairs(bayes *bayesian.Classifier) error {
+	rows, err := db.Query(`SELECT class, sentence FROM training_pairs`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var class, sentence string
+		if err := rows.Scan(&class, &sentence); err != nil {
+			return err
+		}
+		bayes.Learn(strings.Fields(strings.ToLower(sentence)),
+			bayesian.Class(class))
+	}
+	return rows.Err()
+}
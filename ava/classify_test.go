@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jbrukh/bayesian"
+)
+
+func TestTopTwo(t *testing.T) {
+	tests := []struct {
+		name           string
+		classes        []bayesian.Class
+		scores         []float64
+		wantConfidence float64
+		wantCandidates []string
+	}{
+		{
+			"clear winner",
+			[]bayesian.Class{"weather", "reminders", "jokes"},
+			[]float64{-1.0, -4.0, -9.0},
+			3.0,
+			[]string{"weather", "reminders"},
+		},
+		{
+			"unsorted input still ranked",
+			[]bayesian.Class{"jokes", "weather", "reminders"},
+			[]float64{-9.0, -1.0, -4.0},
+			3.0,
+			[]string{"weather", "reminders"},
+		},
+		{
+			"fewer than two classes",
+			[]bayesian.Class{"weather"},
+			[]float64{-1.0},
+			0,
+			nil,
+		},
+		{
+			"no classes",
+			nil,
+			nil,
+			0,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotConfidence, gotCandidates := topTwo(tt.classes, tt.scores)
+			if gotConfidence != tt.wantConfidence {
+				t.Errorf("topTwo() confidence = %v, want %v", gotConfidence, tt.wantConfidence)
+			}
+			if len(gotCandidates) != len(tt.wantCandidates) {
+				t.Fatalf("topTwo() candidates = %v, want %v", gotCandidates, tt.wantCandidates)
+			}
+			for i := range gotCandidates {
+				if gotCandidates[i] != tt.wantCandidates[i] {
+					t.Errorf("topTwo() candidates[%d] = %v, want %v", i, gotCandidates[i], tt.wantCandidates[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+var ErrNoPendingDisambiguation = errors.New("no pending disambiguation")
+var ErrUnauthorizedFeedback = errors.New("unauthorized")
+
+// pendingDisambiguation is a clarifying question asked of a user after
+// classify returned a low-confidence result, stored in training_queue
+// until the user's next turn answers it (or it's superseded).
+type pendingDisambiguation struct {
+	Cmd        string
+	Candidates []string
+}
+
+// disambiguationQuestion renders the clarifying question shown to the
+// user for a pair of candidate classes.
+func disambiguationQuestion(candidates []string) string {
+	return "Did you mean " + candidates[0] + " or " + candidates[1] + "?"
+}
+
+// match reports whether reply selects one of the pending candidates,
+// matching either the class name or its 1-based position in the list.
+func (p *pendingDisambiguation) match(reply string) (string, bool) {
+	reply = strings.TrimSpace(strings.ToLower(reply))
+	for i, c := range p.Candidates {
+		if reply == strings.ToLower(c) || reply == strconv.Itoa(i+1) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// savePendingDisambiguation records a clarifying question for uid,
+// replacing any question already pending for that user.
+func savePendingDisambiguation(uid int, cmd string, candidates []string) error {
+	_, err := db.Exec(
+		`INSERT INTO training_queue (uid, cmd, candidates)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (uid) DO UPDATE
+		 SET cmd = $2, candidates = $3, created_at = now()`,
+		uid, cmd, pq.Array(candidates))
+	return err
+}
+
+// getPendingDisambiguation returns the clarifying question pending for
+// uid, or ErrNoPendingDisambiguation if there isn't one.
+func getPendingDisambiguation(uid int) (*pendingDisambiguation, error) {
+	var cmd string
+	var candidates []string
+	row := db.QueryRow(
+		`SELECT cmd, candidates FROM training_queue WHERE uid=$1`, uid)
+	if err := row.Scan(&cmd, pq.Array(&candidates)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNoPendingDisambiguation
+		}
+		return nil, err
+	}
+	return &pendingDisambiguation{Cmd: cmd, Candidates: candidates}, nil
+}
+
+// clearPendingDisambiguation removes any clarifying question pending for
+// uid, whether or not the user answered it.
+func clearPendingDisambiguation(uid int) error {
+	_, err := db.Exec(`DELETE FROM training_queue WHERE uid=$1`, uid)
+	return err
+}
+
+// feedbackRequest is the body accepted by POST /feedback, letting
+// operators correct a misclassified message from logs.
+type feedbackRequest struct {
+	MessageId      int    `json:"message_id"`
+	CorrectPackage string `json:"correct_package"`
+}
+
+// handlerFeedback re-trains the classifier with the sentence originally
+// sent in message_id, labeled with correct_package, feeding the same
+// online-training path as disambiguation answers. It's operator-only:
+// since it can retrain the shared classifier from any message_id, it's
+// gated on a static bearer token rather than an ordinary user session.
+func handlerFeedback(c *echo.Context) error {
+	if !validOperatorToken(c.Request().Header.Get("X-Operator-Token")) {
+		return ErrUnauthorizedFeedback
+	}
+	var req feedbackRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.MessageId == 0 || len(req.CorrectPackage) == 0 {
+		return errors.New("feedback: message_id and correct_package are required")
+	}
+	var sentence string
+	row := db.QueryRow(
+		`SELECT sentence FROM structured_input WHERE id=$1`, req.MessageId)
+	if err := row.Scan(&sentence); err != nil {
+		return err
+	}
+	if err := trainClass(bayes, req.CorrectPackage, sentence); err != nil {
+		return err
+	}
+	return c.HTML(http.StatusOK, "thanks, retrained")
+}
+
+// validOperatorToken compares token against OPERATOR_TOKEN in constant
+// time. An unset OPERATOR_TOKEN always fails closed.
+func validOperatorToken(token string) bool {
+	want := os.Getenv("OPERATOR_TOKEN")
+	if len(want) == 0 || len(token) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestPendingDisambiguationMatch(t *testing.T) {
+	p := &pendingDisambiguation{
+		Cmd:        "remind me",
+		Candidates: []string{"reminders", "calendar"},
+	}
+	tests := []struct {
+		name      string
+		reply     string
+		wantMatch string
+		wantOK    bool
+	}{
+		{"matches candidate name", "reminders", "reminders", true},
+		{"matches candidate name case-insensitively", "Calendar", "calendar", true},
+		{"matches candidate name with whitespace", "  reminders  ", "reminders", true},
+		{"matches by 1-based position", "1", "reminders", true},
+		{"matches by 1-based position, second candidate", "2", "calendar", true},
+		{"no match on unrelated reply", "weather", "", false},
+		{"no match on out-of-range position", "3", "", false},
+		{"no match on zero position", "0", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := p.match(tt.reply)
+			if ok != tt.wantOK || got != tt.wantMatch {
+				t.Errorf("match(%q) = (%q, %v), want (%q, %v)",
+					tt.reply, got, ok, tt.wantMatch, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/avabot/ava/shared/datatypes"
+	"github.com/avabot/ava/shared/language"
+	"github.com/labstack/echo"
+)
+
+// FlexIdTypePhone identifies a datatypes.User resolved by phone number,
+// the mechanism Twilio uses to address users.
+const FlexIdTypePhone = 2
+
+// twilioMaxSegment is the maximum length of a single SMS segment. Longer
+// replies are split into concatenated segments by sendSMS.
+const twilioMaxSegment = 1600
+
+var ErrInvalidTwilioSignature = errors.New("invalid twilio signature")
+
+// twiMLResponse mirrors Twilio's TwiML envelope for a single SMS/MMS reply.
+type twiMLResponse struct {
+	XMLName xml.Name `xml:"Response"`
+	Message string   `xml:"Message"`
+}
+
+// bootTwilio verifies the Twilio environment is configured. It's a no-op
+// beyond logging today, but gives us one place to grow outbound client
+// setup (e.g. connection pooling) without touching handlerTwilio.
+func bootTwilio() {
+	if len(os.Getenv("TWILIO_AUTH_TOKEN")) == 0 {
+		log.Println("warn: TWILIO_AUTH_TOKEN not set, inbound requests will be rejected")
+	}
+	if len(os.Getenv("TWILIO_SID")) == 0 {
+		log.Println("warn: TWILIO_SID not set, outbound sms disabled")
+	}
+}
+
+// handlerTwilio handles inbound SMS/MMS from Twilio. It validates the
+// request signature, resolves the sending phone number to a
+// datatypes.User, runs the body through the same classify/addContext/
+// callPkg pipeline as handlerMain, and replies with TwiML.
+func handlerTwilio(c *echo.Context) error {
+	r := c.Request()
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	if !validTwilioSignature(r) {
+		return ErrInvalidTwilioSignature
+	}
+	from := r.FormValue("From")
+	cmd := r.FormValue("Body")
+	sid := r.FormValue("MessageSid")
+	if len(from) == 0 {
+		return ErrInvalidCommand
+	}
+	numMedia, err := strconv.Atoi(r.FormValue("NumMedia"))
+	if err != nil {
+		numMedia = 0
+	}
+	var mediaURLs []string
+	for i := 0; i < numMedia; i++ {
+		mediaURLs = append(mediaURLs, r.FormValue("MediaUrl"+strconv.Itoa(i)))
+	}
+	si, _, _, err := classify(bayes, cmd)
+	if err != nil {
+		log.Println("classifying sentence ", err)
+	}
+	si.MessageSid = sid
+	si.MediaURLs = mediaURLs
+	in := &datatypes.Input{
+		StructuredInput: si,
+		FlexId:          from,
+		FlexIdType:      FlexIdTypePhone,
+	}
+	u, err := getUser(in)
+	if err != nil && err != ErrMissingUser {
+		log.Println("getUser: ", err)
+	}
+	m := &datatypes.Message{User: u, Input: in}
+	m, ctxAdded, err := addContext(m)
+	if err != nil {
+		log.Println("addContext: ", err)
+	}
+	ret, pw, err := dispatchPkg(m, ctxAdded)
+	if err != nil && err != ErrMissingPackage {
+		return err
+	}
+	if len(ret) == 0 {
+		ret = language.Confused()
+	}
+	var pname, route string
+	if pw != nil {
+		pname = pw.Name
+		route = pw.Route
+	}
+	if err := saveStructuredInput(in, ret, pname, route); err != nil {
+		log.Println("saveStructuredInput: ", err)
+	}
+	return writeTwiML(c, ret)
+}
+
+func writeTwiML(c *echo.Context, msg string) error {
+	resp := twiMLResponse{Message: msg}
+	b, err := xml.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	out := bytes.NewBufferString(xml.Header)
+	out.Write(b)
+	w := c.Response().Writer()
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// validTwilioSignature recomputes the X-Twilio-Signature header per
+// Twilio's spec: HMAC-SHA1 over the full request URL concatenated with
+// the sorted POST params (key+value, no separator), base64-encoded and
+// compared in constant time.
+func validTwilioSignature(r *http.Request) bool {
+	token := os.Getenv("TWILIO_AUTH_TOKEN")
+	if len(token) == 0 {
+		return false
+	}
+	sig := r.Header.Get("X-Twilio-Signature")
+	if len(sig) == 0 {
+		return false
+	}
+	fullURL := os.Getenv("BASE_URL") + strings.TrimPrefix(r.URL.Path, "/")
+	keys := make([]string, 0, len(r.PostForm))
+	for k := range r.PostForm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString(fullURL)
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteString(r.PostForm.Get(k))
+	}
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write(buf.Bytes())
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(sig)) == 1
+}
+
+// sendSMS sends an outbound text-only SMS via the Twilio REST API, splitting
+// msg into concatenated segments when it exceeds twilioMaxSegment
+// characters. No media URLs are attached, so it does not send MMS.
+func sendSMS(to, msg string) error {
+	sid := os.Getenv("TWILIO_SID")
+	token := os.Getenv("TWILIO_AUTH_TOKEN")
+	from := os.Getenv("TWILIO_FROM")
+	if len(sid) == 0 || len(token) == 0 {
+		return errors.New("twilio not configured")
+	}
+	endpoint := "https://api.twilio.com/2010-04-01/Accounts/" + sid + "/Messages.json"
+	for _, segment := range splitSegments(msg, twilioMaxSegment) {
+		v := url.Values{}
+		v.Set("To", to)
+		v.Set("From", from)
+		v.Set("Body", segment)
+		req, err := http.NewRequest("POST", endpoint,
+			strings.NewReader(v.Encode()))
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(sid, token)
+		req.Header.Set("Content-Type",
+			"application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return errors.New("twilio: unexpected status " +
+				strconv.Itoa(resp.StatusCode))
+		}
+	}
+	return nil
+}
+
+// splitSegments breaks msg into chunks no longer than n runes, preferring
+// to break on word boundaries so concatenated SMS segments read cleanly.
+func splitSegments(msg string, n int) []string {
+	r := []rune(msg)
+	if len(r) <= n {
+		return []string{msg}
+	}
+	var segments []string
+	for len(r) > n {
+		cut := n
+		for i := n - 1; i > 0; i-- {
+			if r[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		segments = append(segments, string(r[:cut]))
+		r = r[cut:]
+		if r[0] == ' ' {
+			r = r[1:]
+		}
+	}
+	if len(r) > 0 {
+		segments = append(segments, string(r))
+	}
+	return segments
+}
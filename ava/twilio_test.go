@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"testing"
+)
+
+// signTestRequest reproduces Twilio's signing algorithm independently of
+// validTwilioSignature, so the test verifies the implementation against
+// the documented spec rather than against itself.
+func signTestRequest(token, fullURL string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString(fullURL)
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteString(form.Get(k))
+	}
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write(buf.Bytes())
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidTwilioSignature(t *testing.T) {
+	const token = "testtoken"
+	const base = "https://example.com/"
+	os.Setenv("BASE_URL", base)
+	os.Setenv("TWILIO_AUTH_TOKEN", token)
+	defer os.Unsetenv("BASE_URL")
+	defer os.Unsetenv("TWILIO_AUTH_TOKEN")
+
+	form := url.Values{"Body": {"hello"}, "From": {"+15551234567"}}
+	validSig := signTestRequest(token, base+"twilio", form)
+
+	tests := []struct {
+		name string
+		sig  string
+		want bool
+	}{
+		{"valid signature", validSig, true},
+		{"tampered signature", validSig[:len(validSig)-1] + "x", false},
+		{"missing signature", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", base+"twilio", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.PostForm = form
+			if len(tt.sig) > 0 {
+				req.Header.Set("X-Twilio-Signature", tt.sig)
+			}
+			if got := validTwilioSignature(req); got != tt.want {
+				t.Errorf("validTwilioSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidTwilioSignatureNoToken(t *testing.T) {
+	os.Unsetenv("TWILIO_AUTH_TOKEN")
+	req, err := http.NewRequest("POST", "https://example.com/twilio", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Twilio-Signature", "anything")
+	if validTwilioSignature(req) {
+		t.Error("validTwilioSignature() = true with no TWILIO_AUTH_TOKEN set, want false")
+	}
+}
+
+func TestSplitSegments(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		n    int
+		want []string
+	}{
+		{"empty message", "", 10, []string{""}},
+		{"exact boundary length", "0123456789", 10, []string{"0123456789"}},
+		{"splits on word boundary", "hello there world", 11, []string{"hello", "there world"}},
+		{"no spaces forces hard cut", "abcdefghijklmnop", 10, []string{"abcdefghij", "klmnop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitSegments(tt.msg, tt.n)
+			if len(got) != len(tt.want) {
+				t.Fatalf("splitSegments(%q, %d) = %q, want %q", tt.msg, tt.n, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("splitSegments(%q, %d)[%d] = %q, want %q", tt.msg, tt.n, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
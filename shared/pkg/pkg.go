@@ -0,0 +1,145 @@
+// Package pkg loads and dispatches ava packages. Packages are compiled as
+// Go plugins (buildmode=plugin) and loaded in-process by Loader, avoiding
+// the port-per-package and TCP round trip that the old RPC transport
+// required. RPC remains available as a fallback for packages that must
+// run out-of-process.
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+
+	"github.com/avabot/ava/shared/datatypes"
+)
+
+var ErrPackageNotFound = errors.New("package not found")
+
+// Config describes a package's identity and the phrases used to train
+// the bayesian classifier against it.
+type Config struct {
+	Name     string
+	Triggers []string
+}
+
+// AvaPackage is the interface every package plugin exports under the
+// symbol name "AvaPackage".
+type AvaPackage interface {
+	Config() Config
+	Run(*datatypes.Message) (string, error)
+	Trigger() *datatypes.StructuredInput
+}
+
+// Pkg wraps a loaded AvaPackage with the Config used to train the
+// classifier and label dispatched messages.
+type Pkg struct {
+	P      AvaPackage
+	Config Config
+}
+
+// PkgWrapper is handed back to callers dispatching a message. Name is
+// always set so callers can label the dispatched message even when P is
+// nil (the RPC fallback transport has no local *Pkg to point to). Route
+// is "plugin" for an in-process plugin; for the RPC fallback it holds
+// whatever route the RPC call reported.
+type PkgWrapper struct {
+	P     *Pkg
+	Name  string
+	Route string
+}
+
+// Loader loads package plugins from Dir and keeps them indexed by name.
+type Loader struct {
+	Dir      string
+	Packages map[string]*Pkg
+}
+
+// NewLoader returns a Loader that will load *.so files from dir.
+func NewLoader(dir string) *Loader {
+	return &Loader{Dir: dir, Packages: make(map[string]*Pkg)}
+}
+
+// Load opens every *.so file in l.Dir, resolves its exported AvaPackage
+// symbol, and registers the package for dispatch. A package that fails to
+// open or doesn't implement AvaPackage is logged and skipped rather than
+// aborting the whole boot.
+func (l *Loader) Load() error {
+	matches, err := filepath.Glob(filepath.Join(l.Dir, "*.so"))
+	if err != nil {
+		return err
+	}
+	for _, path := range matches {
+		if err := l.loadOne(path); err != nil {
+			log.Println("err: loading plugin", path, err)
+		}
+	}
+	return nil
+}
+
+func (l *Loader) loadOne(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := p.Lookup("AvaPackage")
+	if err != nil {
+		return err
+	}
+	avaPkg, ok := sym.(AvaPackage)
+	if !ok {
+		return errors.New("symbol AvaPackage does not implement pkg.AvaPackage")
+	}
+	cfg := avaPkg.Config()
+	l.Packages[cfg.Name] = &Pkg{P: avaPkg, Config: cfg}
+	log.Println("loaded package", cfg.Name)
+	return nil
+}
+
+// Get returns the loaded package registered under name.
+func (l *Loader) Get(name string) (*Pkg, error) {
+	p, ok := l.Packages[name]
+	if !ok {
+		return nil, ErrPackageNotFound
+	}
+	return p, nil
+}
+
+// packageManifest mirrors the "dependencies" map in package.json, where
+// each value is the import path of a package to build.
+type packageManifest struct {
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// Install builds every dependency listed in manifestPath's "dependencies"
+// map as a Go plugin (buildmode=plugin) into dir, so a subsequent Load
+// picks them up.
+func Install(manifestPath, dir string) error {
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var manifest packageManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, src := range manifest.Dependencies {
+		out := filepath.Join(dir, name+".so")
+		log.Println("building package", name)
+		cmd := exec.Command("go", "build", "-buildmode=plugin",
+			"-o", out, src)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}